@@ -23,8 +23,18 @@
 package runtime
 
 import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -32,9 +42,11 @@ import (
 )
 
 const (
-	CACHE_EVICTION_RATE = 30 /// expressed in seconds
-	CACHE_OPENNIC       = "opennic"
-	CACHE_IANA          = "iana"
+	CACHE_EVICTION_RATE   = 30 /// expressed in seconds
+	CACHE_OPENNIC         = "opennic"
+	CACHE_IANA            = "iana"
+	CACHE_DNS64_PREFIX    = "64:ff9b::/96" /// well-known DNS64 prefix, RFC 6052 §2.1
+	CACHE_IP6_ARPA_SUFFIX = "ip6.arpa."
 )
 
 const (
@@ -43,22 +55,52 @@ const (
 	KV_EDNS_ALLERGY   = "skipedns"
 	KV_DS_RR_NUM      = "ds_rr_num"
 	KV_DNSKEY_RR_NUM  = "dnskey_rr_num"
+
+	KV_SERVE_STALE           = "servestale"          /// bool -- enables RFC 8767 serve-stale for a provider
+	KV_SERVE_STALE_GRACE_SEC = "servestalegracesec"  /// int -- grace window past expiry, in seconds
+	KV_PREFETCH              = "prefetch"            /// bool -- enables async prefetch for a provider
+	KV_PREFETCH_FRACTION_PCT = "prefetchfractionpct" /// int -- remaining/original validity threshold, as a percentage
+)
+
+const (
+	CACHE_SERVE_STALE_GRACE_DEFAULT     = 86400 /// seconds, 1 day
+	CACHE_SERVE_STALE_TTL               = 30    /// seconds, clamped TTL on a stale hit
+	CACHE_PREFETCH_FRACTION_DEFAULT_PCT = 10    /// fire prefetch once remaining validity drops under this % of original
+	CACHE_PREFETCH_MIN_VALIDITY         = 30 * time.Second
 )
 
 const (
 	ITEM_CACHE_DNSSEC_DESIGNATION = "dnssec-"
 )
 
+const (
+	snapshotMagic   uint32 = 0x544e5443 /// "TNTC"
+	snapshotVersion uint32 = 1
+
+	snapshotKVString byte = 0
+	snapshotKVInt    byte = 1
+	snapshotKVBool   byte = 2
+)
+
 type DNSCacheHolder struct {
 	m map[string]*DNSCache /// multiplexer for multiple insulated caches
 }
 
 type DNSCache struct {
-	m  *sync.RWMutex           /// global read-write mutex; write is used for map-level operations (INS/DEL keys, cleanup)
-	c  *cleanup                /// global cleanup
-	l  map[string]*domainCache /// the effective front-facing layer of the cache
-	k  *sync.Map               /// key-value store attached to every instance of cache (storing non-RR data)
-	lg *logrus.Entry           /// logging
+	m        *sync.RWMutex           /// global read-write mutex; write is used for map-level operations (INS/DEL keys, cleanup)
+	c        *cleanup                /// global cleanup
+	l        map[string]*domainCache /// the effective front-facing layer of the cache
+	k        *sync.Map               /// key-value store attached to every instance of cache (storing non-RR data); also carries serve-stale/prefetch flags
+	lg       *logrus.Entry           /// logging
+	cap      int                     /// max number of (domain, qtype, mapKey) entries; 0 means unbounded
+	lru      *lruList                /// access-order list used to evict the least recently used entry once len(lru) > cap; nil when cap == 0
+	prefetch atomic.Value            /// holds a func(domain string, qtype uint16), set via DNSCacheHolder.SetPrefetchHandler
+	dns64    *dns64Config            /// non-nil once EnableDNS64 has been called for this provider
+}
+
+// dns64Config holds the DNS64 prefixes registered via EnableDNS64.
+type dns64Config struct {
+	prefixes []*net.IPNet
 }
 
 type domainCache struct {
@@ -74,12 +116,14 @@ type opaqueCacheItem interface {
 	timeCreated() time.Time
 	validity() time.Duration
 	adjustValidity(int64)
+	markPrefetched() bool /// returns true the first time it's called on a given entry, false on every call after
 }
 
 type responseCache struct {
 	time.Time
 	time.Duration
 	*dns.Msg
+	prefetched int32 /// CAS guard for markPrefetched; 0 = not fired, 1 = fired
 }
 
 type itemCache struct {
@@ -87,6 +131,7 @@ type itemCache struct {
 	time.Duration                 /// ttl value
 	dns.RR                        /// the actual record
 	val           *ItemCacheExtra /// other values stored pertaining to the record (DNSSEC situation, etc)
+	prefetched    int32           /// CAS guard for markPrefetched; 0 = not fired, 1 = fired
 }
 
 type cleanup struct {
@@ -111,6 +156,158 @@ type cleanupItem struct {
 type ItemCacheExtra struct {
 	Nxdomain, Nodata, Cname bool
 	Redirect                []*dns.CNAME
+	Stale                   bool /// set when this entry is past TTL but served anyway under the serve-stale grace window
+	Synthesized             bool /// set on a DNS64-synthesized AAAA set
+}
+
+// PrefetchRequest describes a cache entry whose remaining validity has
+// dropped below the configured prefetch threshold. It's informational only --
+// the handler registered via SetPrefetchHandler is invoked with just the
+// Domain/Qtype, since it's already bound to a single provider.
+type PrefetchRequest struct {
+	Provider string
+	Domain   string
+	Qtype    uint16
+}
+
+/*
+** LRU eviction (capacity bound)
+ */
+
+// lruNode is one entry in the access-order list -- it mirrors the location of
+// a cached item as (domain, rrtype, mapKey) rather than holding the item
+// itself, so eviction can reach back into DNSCache.l to delete it.
+type lruNode struct {
+	domain     string
+	rrtype     uint16
+	key        string
+	hash       uint32
+	prev, next *lruNode
+}
+
+// lruList is an auxiliary doubly-linked list, ordered by last access, across
+// all (domain, qtype, mapKey) entries of a single DNSCache. It exists purely
+// to decide what to evict once a cache exceeds its configured capacity --
+// actual storage/removal of cache entries stays in DNSCache.l.
+type lruList struct {
+	m          sync.Mutex
+	cap        int
+	size       int
+	head, tail *lruNode
+	index      map[uint32][]*lruNode /// FNV-1a hash of "domain|qtype|key" -> candidate nodes, collisions resolved by walking the slice
+}
+
+func newLRUList(capacity int) *lruList {
+	return &lruList{cap: capacity, index: make(map[uint32][]*lruNode)}
+}
+
+func lruHash(domain string, rrtype uint16, key string) uint32 {
+	/// FNV-1a
+	const offset32 = 2166136261
+	const prime32 = 16777619
+	h := uint32(offset32)
+	for _, b := range []byte(domain + "|" + dns.TypeToString[rrtype] + "|" + key) {
+		h ^= uint32(b)
+		h *= prime32
+	}
+	return h
+}
+
+func (l *lruList) findLocked(hash uint32, domain string, rrtype uint16, key string) *lruNode {
+	for _, n := range l.index[hash] {
+		if n.domain == domain && n.rrtype == rrtype && n.key == key {
+			return n
+		}
+	}
+	return nil
+}
+
+func (l *lruList) unlinkLocked(n *lruNode) {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		l.head = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		l.tail = n.prev
+	}
+	n.prev, n.next = nil, nil
+}
+
+func (l *lruList) pushFrontLocked(n *lruNode) {
+	n.prev = nil
+	n.next = l.head
+	if l.head != nil {
+		l.head.prev = n
+	}
+	l.head = n
+	if l.tail == nil {
+		l.tail = n
+	}
+}
+
+func (l *lruList) moveToFrontLocked(n *lruNode) {
+	if l.head == n {
+		return
+	}
+	l.unlinkLocked(n)
+	l.pushFrontLocked(n)
+}
+
+func (l *lruList) removeLocked(n *lruNode) {
+	l.unlinkLocked(n)
+	bucket := l.index[n.hash]
+	for i, c := range bucket {
+		if c == n {
+			l.index[n.hash] = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(l.index[n.hash]) == 0 {
+		delete(l.index, n.hash)
+	}
+	l.size--
+}
+
+// remove prunes the node for (domain, rrtype, key), if one exists, without
+// counting it as an access or an eviction. Every path that deletes a cache
+// entry outside of insertInternal's own capacity check (expiry in retrieve,
+// the cleanup goroutine, debugFlush) must call this, or the orphaned node
+// lingers in the list and l.size overcounts how many entries are actually
+// live.
+func (l *lruList) remove(domain string, rrtype uint16, key string) {
+	h := lruHash(domain, rrtype, key)
+	l.m.Lock()
+	defer l.m.Unlock()
+	if n := l.findLocked(h, domain, rrtype, key); n != nil {
+		l.removeLocked(n)
+	}
+}
+
+// touch records an access (on retrieve) or an insert (on insertInternal) for
+// (domain, rrtype, key): an existing node moves to the front, a new one is
+// pushed to the front and counted. If the list is now over capacity, the tail
+// node is evicted from the list and returned so the caller can remove the
+// matching entry from DNSCache.l.
+func (l *lruList) touch(domain string, rrtype uint16, key string) (victim *lruNode) {
+	h := lruHash(domain, rrtype, key)
+	l.m.Lock()
+	defer l.m.Unlock()
+	if n := l.findLocked(h, domain, rrtype, key); n != nil {
+		l.moveToFrontLocked(n)
+		return nil
+	}
+	n := &lruNode{domain: domain, rrtype: rrtype, key: key, hash: h}
+	l.pushFrontLocked(n)
+	l.index[h] = append(l.index[h], n)
+	l.size++
+	if l.cap > 0 && l.size > l.cap {
+		victim = l.tail
+		l.removeLocked(victim)
+	}
+	return victim
 }
 
 /*
@@ -142,6 +339,10 @@ func (i *itemCache) adjustValidity(delta int64) {
 	i.Duration = time.Duration(i.Header().Ttl) * time.Second
 }
 
+func (i *itemCache) markPrefetched() bool {
+	return atomic.CompareAndSwapInt32(&i.prefetched, 0, 1)
+}
+
 func (r *responseCache) isDNSSECStore() bool {
 	return true
 }
@@ -176,6 +377,10 @@ func (r *responseCache) adjustValidity(delta int64) {
 	r.Duration = time.Duration(minTTL) * time.Second
 }
 
+func (r *responseCache) markPrefetched() bool {
+	return atomic.CompareAndSwapInt32(&r.prefetched, 0, 1)
+}
+
 /*
 ** Runtime module functions
  */
@@ -184,14 +389,15 @@ func (r *responseCache) adjustValidity(delta int64) {
 func StartCache(log *logrus.Entry, designations ...string) *DNSCacheHolder {
 	ret := &DNSCacheHolder{make(map[string]*DNSCache)}
 
-	for _, cn := range designations {
-		ret.m[cn] = &DNSCache{
+	for _, name := range designations {
+		c := &DNSCache{
 			m:  new(sync.RWMutex),
 			c:  newCleanup(),
 			l:  make(map[string]*domainCache),
 			k:  new(sync.Map),
-			lg: log.WithField("provider", cn),
+			lg: log.WithField("provider", name),
 		}
+		ret.m[name] = c
 	}
 
 	if len(designations) != len(ret.m) {
@@ -206,6 +412,25 @@ func StartCache(log *logrus.Entry, designations ...string) *DNSCacheHolder {
 	return ret
 }
 
+// SetCapacity bounds provider's cache to at most capacity (domain, qtype,
+// mapKey) entries: once exceeded, insertInternal evicts the least recently
+// used entry to make room. This is the config knob behind the LRU eviction
+// added in chunk0-1 -- like EnableDNS64, call it once during setup, before
+// the provider takes traffic. Pass capacity <= 0 to leave it unbounded
+// (the default).
+func (d *DNSCacheHolder) SetCapacity(provider string, capacity int) {
+	c, ok := d.m[provider]
+	if !ok {
+		return
+	}
+	c.cap = capacity
+	if capacity > 0 {
+		c.lru = newLRUList(capacity)
+	} else {
+		c.lru = nil
+	}
+}
+
 // Stop -- stops caching (stops cleanup thread)
 func (d *DNSCacheHolder) Stop() {
 	for _, c := range d.m {
@@ -213,6 +438,24 @@ func (d *DNSCacheHolder) Stop() {
 	}
 }
 
+// SetPrefetchHandler registers fn to be called, at most once per entry, once
+// a cached entry's remaining TTL drops below the configured prefetch
+// threshold for provider. Pass a nil fn to unregister.
+func (d *DNSCacheHolder) SetPrefetchHandler(provider string, fn func(domain string, qtype uint16)) {
+	if c, ok := d.m[provider]; ok {
+		c.prefetch.Store(fn)
+	}
+}
+
+func (d *DNSCache) prefetchHandler() func(domain string, qtype uint16) {
+	if v := d.prefetch.Load(); v != nil {
+		if fn, ok := v.(func(domain string, qtype uint16)); ok {
+			return fn
+		}
+	}
+	return nil
+}
+
 /*
 ** KV Store primitives
  */
@@ -262,6 +505,73 @@ func (d *DNSCacheHolder) GetBool(provider, key string) (bool, bool) {
 	return retb, true
 }
 
+/*
+** Serve-stale / prefetch configuration (read from the per-provider KV store)
+ */
+
+func (d *DNSCache) serveStaleEnabled() bool {
+	v, ok := d.k.Load(KV_SERVE_STALE)
+	b, _ := v.(bool)
+	return ok && b
+}
+
+func (d *DNSCache) staleGrace() time.Duration {
+	if v, ok := d.k.Load(KV_SERVE_STALE_GRACE_SEC); ok {
+		if sec, ok := v.(int); ok && sec > 0 {
+			return time.Duration(sec) * time.Second
+		}
+	}
+	return CACHE_SERVE_STALE_GRACE_DEFAULT * time.Second
+}
+
+func (d *DNSCache) prefetchEnabled() bool {
+	v, ok := d.k.Load(KV_PREFETCH)
+	b, _ := v.(bool)
+	return ok && b
+}
+
+func (d *DNSCache) prefetchFraction() float64 {
+	if v, ok := d.k.Load(KV_PREFETCH_FRACTION_PCT); ok {
+		if pct, ok := v.(int); ok && pct > 0 {
+			return float64(pct) / 100.0
+		}
+	}
+	return float64(CACHE_PREFETCH_FRACTION_DEFAULT_PCT) / 100.0
+}
+
+// shouldPrefetch reports whether v's remaining validity has dropped below the
+// configured prefetch fraction of its original validity, and whether the
+// original validity even qualifies (very short-lived entries are not worth
+// prefetching).
+func (d *DNSCache) shouldPrefetch(v opaqueCacheItem) bool {
+	original := v.validity()
+	if original < CACHE_PREFETCH_MIN_VALIDITY {
+		return false
+	}
+	remaining := original - time.Now().Sub(v.timeCreated())
+	if remaining <= 0 {
+		return false
+	}
+	return float64(remaining)/float64(original) < d.prefetchFraction()
+}
+
+// maybePrefetch fires the registered prefetch handler for v, at most once per
+// entry, if prefetch is enabled and v qualifies.
+func (d *DNSCache) maybePrefetch(domain string, t uint16, v opaqueCacheItem) {
+	if !d.prefetchEnabled() || !d.shouldPrefetch(v) {
+		return
+	}
+	h := d.prefetchHandler()
+	if h == nil {
+		return
+	}
+	if !v.markPrefetched() {
+		return
+	}
+	req := PrefetchRequest{Domain: domain, Qtype: t}
+	go h(req.Domain, req.Qtype)
+}
+
 /*
 ** Core cache functionalities
  */
@@ -277,6 +587,43 @@ func (d *DNSCacheHolder) Insert(provider, domain string, rr dns.RR, extra *ItemC
 	}
 }
 
+// InsertFlags carries optional per-insert behavior for InsertWithFlags.
+type InsertFlags struct {
+	// FlushExisting mirrors the mDNS cache-flush bit semantics described in
+	// go-mdns-sd: every cached entry for (domain, rr.Header().Rrtype) is
+	// dropped before the new RR is inserted, instead of being merged in
+	// alongside it.
+	FlushExisting bool
+}
+
+// InsertWithFlags is Insert plus InsertFlags. Callers use FlushExisting when
+// an authoritative source indicates the previous answer set for (domain,
+// qtype) is no longer valid -- e.g. a CNAME chain changed -- rather than
+// waiting for TTL expiry.
+func (d *DNSCacheHolder) InsertWithFlags(provider, domain string, rr dns.RR, extra *ItemCacheExtra, flags InsertFlags) {
+	if flags.FlushExisting {
+		if c, ok := d.m[provider]; ok {
+			c.debugFlush(domain, rr.Header().Rrtype)
+		}
+	}
+	d.Insert(provider, domain, rr, extra)
+}
+
+// Invalidate removes all cached entries -- regular RRs and DNSSEC responses
+// alike -- for (domain, qtype) from provider's cache.
+func (d *DNSCacheHolder) Invalidate(provider, domain string, qtype uint16) {
+	if c, ok := d.m[provider]; ok {
+		c.debugFlush(domain, qtype)
+	}
+}
+
+// InvalidateAll empties provider's cache entirely.
+func (d *DNSCacheHolder) InvalidateAll(provider string) {
+	if c, ok := d.m[provider]; ok {
+		c.debugFlush("", 0)
+	}
+}
+
 func (d *DNSCacheHolder) InsertResponse(provider, domain string, r *dns.Msg) {
 	/// it's oversimplified, but needs to be in order to be in sync with the rest of the cache
 	/// TODO: complicate this part a bit
@@ -293,14 +640,97 @@ func (d *DNSCacheHolder) InsertResponse(provider, domain string, r *dns.Msg) {
 }
 
 func (d *DNSCacheHolder) Retrieve(provider, domain string, t uint16, dnssec bool) (ret interface{}, extra *ItemCacheExtra) {
-	if c, ok := d.m[provider]; ok {
-		return c.retrieve(domain, t, dnssec)
+	c, ok := d.m[provider]
+	if !ok {
+		return nil, nil
+	}
+	ret, extra = c.retrieve(domain, t, dnssec)
+
+	/// DNS64: an empty AAAA answer is a candidate for synthesis from the A
+	/// store, provided the provider opted in and the query isn't a reverse
+	/// lookup under ip6.arpa (synthesizing those would be nonsensical)
+	if t == dns.TypeAAAA && !dnssec && c.dns64 != nil && len(AsRR(ret)) == 0 &&
+		!strings.HasSuffix(strings.ToLower(domain), CACHE_IP6_ARPA_SUFFIX) {
+		if synthesized, synthExtra, ok := c.synthesizeDNS64(domain); ok {
+			return synthesized, synthExtra
+		}
 	}
-	return nil, nil
+	return ret, extra
+}
+
+// EnableDNS64 turns on DNS64 AAAA synthesis for provider: once enabled, an
+// empty AAAA Retrieve falls back to synthesizing AAAA records from the
+// cached A set, per RFC 6147 §5.1.7. With no prefixes given, the well-known
+// 64:ff9b::/96 prefix is used.
+func (d *DNSCacheHolder) EnableDNS64(provider string, prefixes []*net.IPNet) {
+	c, ok := d.m[provider]
+	if !ok {
+		return
+	}
+	if len(prefixes) == 0 {
+		_, def, _ := net.ParseCIDR(CACHE_DNS64_PREFIX)
+		prefixes = []*net.IPNet{def}
+	}
+	c.dns64 = &dns64Config{prefixes: prefixes}
+}
+
+// synthesizeDNS64 looks up the A records cached for domain and, if any
+// exist, synthesizes AAAA records by embedding each address into the first
+// configured DNS64 prefix, per RFC 6147 §5.1.7 / RFC 6052 §2.2.
+func (d *DNSCache) synthesizeDNS64(domain string) (synthesized []dns.RR, extra *ItemCacheExtra, ok bool) {
+	aRet, _ := d.retrieve(domain, dns.TypeA, false)
+	prefix := d.dns64.prefixes[0]
+	for _, rr := range AsRR(aRet) {
+		a, isA := rr.(*dns.A)
+		if !isA || a.A.To4() == nil {
+			continue
+		}
+		synthesized = append(synthesized, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   rr.Header().Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  rr.Header().Class,
+				Ttl:    rr.Header().Ttl,
+			},
+			AAAA: embedDNS64(prefix, a.A.To4()),
+		})
+	}
+	if len(synthesized) == 0 {
+		return nil, nil, false
+	}
+	return synthesized, &ItemCacheExtra{Synthesized: true}, true
+}
+
+// embedDNS64 embeds a 32-bit IPv4 address into prefix following the RFC 6052
+// §2.2 address format table (bits 64-71 are the reserved "u" octet and stay
+// zero for every prefix length shorter than /96).
+func embedDNS64(prefix *net.IPNet, v4 net.IP) net.IP {
+	plen, _ := prefix.Mask.Size()
+	out := make(net.IP, net.IPv6len)
+	copy(out, prefix.IP.To16())
+
+	switch plen {
+	case 32:
+		copy(out[4:8], v4)
+	case 40:
+		copy(out[5:8], v4[0:3])
+		out[9] = v4[3]
+	case 48:
+		copy(out[6:8], v4[0:2])
+		copy(out[9:11], v4[2:4])
+	case 56:
+		out[7] = v4[0]
+		copy(out[9:12], v4[1:4])
+	case 64:
+		copy(out[9:13], v4)
+	default: /// 96, and anything non-standard -- treat as /96
+		copy(out[12:16], v4)
+	}
+	return out
 }
 
 func itemCacheFromRR(rr dns.RR, extra *ItemCacheExtra) *itemCache {
-	return &itemCache{time.Now(), time.Duration(rr.Header().Ttl) * time.Second, rr, extra}
+	return &itemCache{time.Now(), time.Duration(rr.Header().Ttl) * time.Second, rr, extra, 0}
 }
 
 func responseCacheFromMsg(m *dns.Msg) *responseCache {
@@ -315,7 +745,7 @@ func responseCacheFromMsg(m *dns.Msg) *responseCache {
 		}
 	}
 
-	return &responseCache{time.Now(), minTTL, m}
+	return &responseCache{time.Now(), minTTL, m, 0}
 }
 
 /// returns a string reprezentation of a resource record, with volatile parts wiped (eg. TTL) for comparison purposes
@@ -339,6 +769,17 @@ func (d *DNSCache) insertResponse(domain string, resp *dns.Msg) {
 }
 
 func (d *DNSCache) insertInternal(_domain string, cachee opaqueCacheItem) {
+	d.insertAt(_domain, cachee, time.Now().Unix()+int64(cachee.validity()/time.Second))
+}
+
+// insertPreserving inserts a cache entry restored from a Snapshot without
+// resetting its clock: unlike insertInternal, the cleanup deadline is
+// computed from the entry's own timeCreated rather than from time.Now().
+func (d *DNSCache) insertPreserving(_domain string, cachee opaqueCacheItem) {
+	d.insertAt(_domain, cachee, cachee.timeCreated().Unix()+int64(cachee.validity()/time.Second))
+}
+
+func (d *DNSCache) insertAt(_domain string, cachee opaqueCacheItem, cleanupWhen int64) {
 	domain := strings.ToLower(_domain)
 	// d.lg.Infof("Inserting for [%s]", domain)
 	d.m.Lock()
@@ -348,18 +789,54 @@ func (d *DNSCache) insertInternal(_domain string, cachee opaqueCacheItem) {
 		d.l[domain] = dom
 	}
 	dom.m.Lock()
-	defer dom.m.Unlock()
 	d.m.Unlock()
 	rrtype := cachee.keyQType()
 	if _, ok := dom.l[rrtype]; !ok {
 		dom.l[rrtype] = make(map[string]opaqueCacheItem)
 	}
-	dom.l[rrtype][cachee.mapKey()] = cachee
-	/// submit item for cleanup
-	// d.c.c <- &cleanupItem{
-	// 	domain, rrtype, cachee.mapKey(),
-	// 	time.Now().Unix() +
-	// 		int64(cachee.validity()/time.Second)}
+	key := cachee.mapKey()
+	dom.l[rrtype][key] = cachee
+	dom.m.Unlock()
+	/// submit item for cleanup; re-inserts just queue a second, later-firing
+	/// cleanupItem -- the cleanup goroutine re-checks actual validity before
+	/// deleting, so the stale item from the first queueing is a no-op
+	d.c.c <- &cleanupItem{domain, rrtype, key, cleanupWhen}
+
+	/// enforce the LRU capacity bound, if configured; dom.m is already
+	/// released above so evicting the tail (possibly from this very domain)
+	/// can't deadlock against it
+	if d.cap > 0 {
+		if victim := d.lru.touch(domain, rrtype, key); victim != nil {
+			d.evict(victim.domain, victim.rrtype, victim.key)
+		}
+	}
+}
+
+// evict removes a single (domain, rrtype, key) entry from the cache, cleaning
+// up the rrtype map and the domain entry itself once they're left empty. It's
+// used by the LRU eviction path in insertInternal.
+func (d *DNSCache) evict(domain string, rrtype uint16, key string) {
+	d.m.RLock()
+	dom, ok := d.l[domain]
+	if !ok {
+		d.m.RUnlock()
+		return
+	}
+	dom.m.Lock()
+	d.m.RUnlock()
+	delete(dom.l[rrtype], key)
+	if len(dom.l[rrtype]) == 0 {
+		delete(dom.l, rrtype)
+	}
+	empty := len(dom.l) == 0
+	dom.m.Unlock()
+	if empty {
+		d.m.Lock()
+		if cur, ok := d.l[domain]; ok && cur == dom && len(dom.l) == 0 {
+			delete(d.l, domain)
+		}
+		d.m.Unlock()
+	}
 }
 
 func (d *DNSCache) retrieve(domain string, t uint16, dnssec bool) (ret interface{}, extra *ItemCacheExtra) {
@@ -383,63 +860,95 @@ func (d *DNSCache) retrieve(domain string, t uint16, dnssec bool) (ret interface
 		// 	d.lg.Debugf("We have DNSSEC  [%s] -- [%s]", k, cahceElemType.Question[0].String())
 		// }
 
-		/// if item is queried before rounded eviction time
-		if v.timeCreated().Add(v.validity()).Before(time.Now()) {
+		/// touch the LRU entry on every hit, regardless of which branch below ends up serving it
+		if d.cap > 0 {
+			d.lru.touch(domain, t, k)
+		}
+
+		expiry := v.timeCreated().Add(v.validity())
+		stale := expiry.Before(time.Now())
+
+		/// if item is queried past its eviction time and serve-stale can't cover it, drop it
+		if stale && (!d.serveStaleEnabled() || time.Now().Sub(expiry) > d.staleGrace()) {
 			// d.lg.Debugf("Deleting record, because [%v] + [%v] > [%v]", v.timeCreated(), v.validity(), time.Now())
 			defer func() {
 				dom.m.Lock()
 				delete(interm, k)
 				dom.m.Unlock()
+				if d.cap > 0 {
+					d.lru.remove(domain, t, k)
+				}
 			}()
 			continue
-		} else { /// if opaque cache item has valid TTL
+		} else { /// if opaque cache item has valid TTL, or is within the serve-stale grace window
 			// d.lg.Debugf("Item is within validity period. Returning as requested, or as possible.")
 			if dnssec && v.isDNSSECStore() { /// if we need dnssec and we have a dnssec response, we return *the* response (only one of those per RRtype)
 				// d.lg.Debugf("Returning DNSSEC cache -- [%v]", v.(*responseCache).Msg.Question[0])
-				// defer func(m *sync.RWMutex) {
-				// 	m.Lock()
-				// 	v.adjustValidity(int64(-time.Now().Sub(v.timeCreated()) / time.Second))
-				// 	m.Unlock()
-				// }(dom.m)
 				src := v.(*responseCache).Msg
 				retResp := cloneResponse(src)
-				for hldIndex, holder := range [][]dns.RR{src.Answer, src.Ns, cleanAdditionalSection(src.Extra)} {
+				elapsed := uint32(time.Now().Sub(v.timeCreated()) / time.Second)
+				for hldIndex, holder := range [][]dns.RR{retResp.Answer, retResp.Ns, cleanAdditionalSection(retResp.Extra)} {
 					for _, rr := range holder {
 						if rr != nil {
-							rr.Header().Ttl = rr.Header().Ttl - uint32(time.Now().Sub(v.timeCreated())/time.Second)
+							if stale {
+								rr.Header().Ttl = CACHE_SERVE_STALE_TTL
+							} else {
+								rr.Header().Ttl = rr.Header().Ttl - elapsed
+							}
 						} else if hldIndex == 0 { /// if a record got stale from the answer section, remove this entry from cache
 							defer func() {
 								dom.m.Lock()
 								delete(interm, k)
 								dom.m.Unlock()
+								if d.cap > 0 {
+									d.lru.remove(domain, t, k)
+								}
 							}()
 							continue
 						}
 					}
 				}
+				var respExtra *ItemCacheExtra
+				if stale {
+					respExtra = &ItemCacheExtra{Stale: true}
+				} else {
+					d.maybePrefetch(domain, t, v)
+				}
 				dom.m.RUnlock()
-				return retResp, nil
+				return retResp, respExtra
 			} else if !v.isDNSSECStore() {
 				// d.lg.Debugf("Returning regular cache item -- [%v]", v.(*itemCache).RR)
-				// defer func(m *sync.RWMutex) {
-				// 	m.Lock()
-				// v.adjustValidity(int64(-time.Now().Sub(v.timeCreated()) / time.Second))
-				// 	m.Unlock()
-				// }(dom.m)
 				retRR := dns.Copy(v.(*itemCache).RR)
-				if retRR.Header().Ttl > uint32(time.Now().Sub(v.timeCreated())/time.Second) {
-					retRR.Header().Ttl = retRR.Header().Ttl - uint32(time.Now().Sub(v.timeCreated())/time.Second)
+				elapsed := uint32(time.Now().Sub(v.timeCreated()) / time.Second)
+				if stale {
+					retRR.Header().Ttl = CACHE_SERVE_STALE_TTL
+				} else if retRR.Header().Ttl > elapsed {
+					retRR.Header().Ttl = retRR.Header().Ttl - elapsed
 				} else {
 					defer func() {
 						dom.m.Lock()
 						delete(interm, k)
 						dom.m.Unlock()
+						if d.cap > 0 {
+							d.lru.remove(domain, t, k)
+						}
 					}()
 					continue
 				}
 				retRegular = append(retRegular, retRR)
-				if extra == nil && v.(*itemCache).val != nil {
-					extra = v.(*itemCache).val
+				itemExtra := v.(*itemCache).val
+				if stale {
+					staleExtra := ItemCacheExtra{Stale: true}
+					if itemExtra != nil {
+						staleExtra = *itemExtra
+						staleExtra.Stale = true
+					}
+					itemExtra = &staleExtra
+				} else {
+					d.maybePrefetch(domain, t, v)
+				}
+				if extra == nil && itemExtra != nil {
+					extra = itemExtra
 				}
 			}
 		}
@@ -486,6 +995,16 @@ func cloneResponse(in *dns.Msg) (out *dns.Msg) {
 ** Cache cleanup
  */
 
+// cleanupBucketIndex returns the d.c.i key a cleanupItem due at when lands
+// in, given the cleanup's current origin o: the first multiple of
+// CACHE_EVICTION_RATE at or after when, measured from o. Rounding up (not
+// down) matters -- a bucket that fires before an entry's expiry gets a
+// re-check that finds it still valid and is discarded right after, so the
+// entry would never be reclaimed without a later retrieve.
+func cleanupBucketIndex(o, when int64) int64 {
+	return o + int64(math.Ceil(float64(when-o)/float64(CACHE_EVICTION_RATE)))*CACHE_EVICTION_RATE
+}
+
 func newCleanup() *cleanup {
 	return &cleanup{make(map[int64][]*cleanupItem), time.NewTicker(CACHE_EVICTION_RATE * time.Second), make(chan *cleanupItem, 1000),
 		make(chan bool, 1), new(sync.WaitGroup), time.Now().Unix()}
@@ -499,49 +1018,93 @@ func (d *DNSCache) startCleanup() {
 		for {
 			select {
 			/// time for cleanup
-			// case <-d.c.t.C:
-			// 	/// update origin
-			// 	d.c.o += CACHE_EVICTION_RATE
-			// 	/// get cleanable elements
-			// 	evictees := d.c.i[d.c.o]
-			// 	/// cycle all elements and remove references to them
-			// 	cleanStart := time.Now()
-			// 	timeWait := time.Duration(0)
-			// 	for _, e := range evictees {
-
-			// 		fmt.Printf("Evicting [%s/%s/%s]\n", e.firstKey, dns.TypeToString[e.secondKey], e.key)
-			// 		yolo := time.Now()
-			// 		d.m.RLock()
-			// 		timeWait += time.Now().Sub(yolo)
-			// 		dom, ok := d.l[e.firstKey]
-			// 		if !ok {
-			// 			d.m.RUnlock()
-			// 			/// this should raise some eyebrows
-			// 			continue
-			// 		}
-			// 		yolo = time.Now()
-			// 		dom.m.Lock()
-			// 		timeWait += time.Now().Sub(yolo)
-			// 		d.m.RUnlock()
-			// 		/// we delete the key
-			// 		delete(dom.l[e.secondKey], e.key)
-			// 		/// if we left the type map empty, delete the type index too
-			// 		if len(dom.l[e.secondKey]) == 0 {
-			// 			delete(dom.l, e.secondKey)
-			// 		}
-			// 		dom.m.Unlock()
-			// 	}
-			// 	d.lg.Infof("Evicted [%d] items, in %v time out of which %v was lockwait", len(evictees), time.Now().Sub(cleanStart), timeWait)
+			case <-d.c.t.C:
+				/// update origin
+				d.c.o += CACHE_EVICTION_RATE
+				/// get cleanable elements
+				evictees := d.c.i[d.c.o]
+				/// cycle all elements and remove references to them
+				cleanStart := time.Now()
+				timeWait := time.Duration(0)
+				evicted := 0
+				for _, e := range evictees {
+					yolo := time.Now()
+					d.m.RLock()
+					timeWait += time.Now().Sub(yolo)
+					dom, ok := d.l[e.firstKey]
+					if !ok {
+						d.m.RUnlock()
+						/// this should raise some eyebrows
+						continue
+					}
+					yolo = time.Now()
+					dom.m.Lock()
+					timeWait += time.Now().Sub(yolo)
+					d.m.RUnlock()
+					cur, ok := dom.l[e.secondKey][e.key]
+					if !ok {
+						dom.m.Unlock()
+						continue
+					}
+					/// the entry may have been refreshed (re-insert queued a later
+					/// cleanupItem) since this eviction was scheduled -- only delete
+					/// it if it's genuinely expired by now
+					expiry := cur.timeCreated().Add(cur.validity())
+					now := time.Now()
+					if expiry.After(now) {
+						dom.m.Unlock()
+						continue
+					}
+					/// serve-stale entries stay queryable past expiry -- don't reap them
+					/// out from under the grace window; requeue so they're still
+					/// reclaimed once grace lapses, even if nothing retrieves them
+					if d.serveStaleEnabled() {
+						if grace := d.staleGrace(); now.Sub(expiry) <= grace {
+							dom.m.Unlock()
+							select {
+							case d.c.c <- &cleanupItem{e.firstKey, e.secondKey, e.key, expiry.Add(grace).Unix()}:
+							default:
+							}
+							continue
+						}
+					}
+					/// we delete the key
+					delete(dom.l[e.secondKey], e.key)
+					/// if we left the type map empty, delete the type index too
+					if len(dom.l[e.secondKey]) == 0 {
+						delete(dom.l, e.secondKey)
+					}
+					domEmpty := len(dom.l) == 0
+					dom.m.Unlock()
+					if domEmpty {
+						d.m.Lock()
+						if cur, ok := d.l[e.firstKey]; ok && cur == dom && len(dom.l) == 0 {
+							delete(d.l, e.firstKey)
+						}
+						d.m.Unlock()
+					}
+					if d.cap > 0 {
+						d.lru.remove(e.firstKey, e.secondKey, e.key)
+					}
+					evicted++
+				}
+				delete(d.c.i, d.c.o)
+				d.lg.Infof("Evicted [%d] items, in %v time out of which %v was lockwait", evicted, time.Now().Sub(cleanStart), timeWait)
 			case <-d.c.q:
 				/// maybe a simple return would suffice here?
+				/// note: d.c.c is buffered, so a burst of inserts right before
+				/// shutdown can leave items sitting in it unbucketed -- that's
+				/// fine, they die with the rest of the (now unused) DNSCache
 				isQuitting = true
 				break
-				// case target := <-d.c.c:
-				// 	if target.when < d.c.o+CACHE_EVICTION_RATE {
-				// 		continue
-				// 	}
-				// 	index := d.c.o + int64(math.Floor(float64(target.when-d.c.o)/float64(CACHE_EVICTION_RATE)))
-				// 	d.c.i[index] = append(d.c.i[index], target)
+			case target := <-d.c.c:
+				index := cleanupBucketIndex(d.c.o, target.when)
+				/// items already due, or due within the current interval, go to
+				/// the next bucket instead of being dropped
+				if index < d.c.o+CACHE_EVICTION_RATE {
+					index = d.c.o + CACHE_EVICTION_RATE
+				}
+				d.c.i[index] = append(d.c.i[index], target)
 			}
 			if isQuitting == true {
 				break
@@ -557,6 +1120,658 @@ func (d *DNSCache) stopCleanup() {
 	d.c.w.Wait()
 }
 
+/*
+** Snapshot persistence
+ */
+
+// Snapshot serializes every provider's live entries, plus their KV stores,
+// to a single file at path using a length-prefixed binary framing. It's
+// meant to be paired with LoadSnapshot so a restarted server doesn't have to
+// warm its caches from scratch.
+func (d *DNSCacheHolder) Snapshot(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := binary.Write(w, binary.BigEndian, snapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, snapshotVersion); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(d.m))); err != nil {
+		return err
+	}
+	for name, c := range d.m {
+		if err := writeString(w, name); err != nil {
+			return err
+		}
+		if err := c.snapshot(w); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// LoadSnapshot restores the providers/entries/KV values written by Snapshot.
+// Entries whose remaining validity has already run out are skipped.
+func (d *DNSCacheHolder) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var magic, version uint32
+	if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
+		return err
+	}
+	if magic != snapshotMagic {
+		return fmt.Errorf("cache: %s is not a cache snapshot file", path)
+	}
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("cache: unsupported snapshot version %d in %s", version, path)
+	}
+
+	var numProviders uint32
+	if err := binary.Read(r, binary.BigEndian, &numProviders); err != nil {
+		return err
+	}
+	for i := uint32(0); i < numProviders; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return err
+		}
+		c, ok := d.m[name]
+		if !ok {
+			return fmt.Errorf("cache: snapshot references unknown provider %q", name)
+		}
+		if err := c.loadSnapshot(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DNSCache) snapshot(w io.Writer) error {
+	type bucket struct {
+		domain string
+		rrtype uint16
+		items  []opaqueCacheItem
+	}
+
+	d.m.RLock()
+	buckets := make([]bucket, 0, len(d.l))
+	for domain, dom := range d.l {
+		dom.m.RLock()
+		for rrtype, items := range dom.l {
+			b := bucket{domain: domain, rrtype: rrtype, items: make([]opaqueCacheItem, 0, len(items))}
+			for _, it := range items {
+				b.items = append(b.items, it)
+			}
+			buckets = append(buckets, b)
+		}
+		dom.m.RUnlock()
+	}
+	d.m.RUnlock()
+
+	if err := binary.Write(w, binary.BigEndian, uint32(len(buckets))); err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		if err := writeString(w, b.domain); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, b.rrtype); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, uint32(len(b.items))); err != nil {
+			return err
+		}
+		for _, it := range b.items {
+			if err := writeItem(w, it); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.snapshotKV(w)
+}
+
+func writeItem(w io.Writer, it opaqueCacheItem) error {
+	if err := binary.Write(w, binary.BigEndian, it.timeCreated().UnixNano()); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, int64(it.validity()/time.Second)); err != nil {
+		return err
+	}
+	isDNSSEC := it.isDNSSECStore()
+	if err := binary.Write(w, binary.BigEndian, isDNSSEC); err != nil {
+		return err
+	}
+
+	var payload []byte
+	var err error
+	if isDNSSEC {
+		payload, err = it.(*responseCache).Msg.Pack()
+	} else {
+		payload = []byte(it.(*itemCache).RR.String())
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeBytes(w, payload); err != nil {
+		return err
+	}
+	if isDNSSEC {
+		return nil
+	}
+	return writeItemCacheExtra(w, it.(*itemCache).val)
+}
+
+func writeItemCacheExtra(w io.Writer, val *ItemCacheExtra) error {
+	if val == nil {
+		return binary.Write(w, binary.BigEndian, false)
+	}
+	if err := binary.Write(w, binary.BigEndian, true); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, val.Nxdomain); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, val.Nodata); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, val.Cname); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(val.Redirect))); err != nil {
+		return err
+	}
+	for _, cname := range val.Redirect {
+		if err := writeString(w, cname.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DNSCache) snapshotKV(w io.Writer) error {
+	type kv struct {
+		key  string
+		kind byte
+		sval string
+		ival int64
+		bval bool
+	}
+
+	var entries []kv
+	d.k.Range(func(rawKey, rawVal interface{}) bool {
+		key, ok := rawKey.(string)
+		if !ok {
+			return true
+		}
+		switch val := rawVal.(type) {
+		case string:
+			entries = append(entries, kv{key: key, kind: snapshotKVString, sval: val})
+		case int:
+			entries = append(entries, kv{key: key, kind: snapshotKVInt, ival: int64(val)})
+		case bool:
+			entries = append(entries, kv{key: key, kind: snapshotKVBool, bval: val})
+		}
+		/// other value types aren't persisted -- there's no generic wire format for them
+		return true
+	})
+
+	if err := binary.Write(w, binary.BigEndian, uint32(len(entries))); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := writeString(w, e.key); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, e.kind); err != nil {
+			return err
+		}
+		switch e.kind {
+		case snapshotKVString:
+			if err := writeString(w, e.sval); err != nil {
+				return err
+			}
+		case snapshotKVInt:
+			if err := binary.Write(w, binary.BigEndian, e.ival); err != nil {
+				return err
+			}
+		case snapshotKVBool:
+			if err := binary.Write(w, binary.BigEndian, e.bval); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DNSCache) loadSnapshot(r io.Reader) error {
+	var numBuckets uint32
+	if err := binary.Read(r, binary.BigEndian, &numBuckets); err != nil {
+		return err
+	}
+	for i := uint32(0); i < numBuckets; i++ {
+		domain, err := readString(r)
+		if err != nil {
+			return err
+		}
+		var rrtype uint16
+		if err := binary.Read(r, binary.BigEndian, &rrtype); err != nil {
+			return err
+		}
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return err
+		}
+		for j := uint32(0); j < count; j++ {
+			item, err := readItem(r)
+			if err != nil {
+				return err
+			}
+			if item == nil {
+				continue /// already expired while at rest
+			}
+			d.insertPreserving(domain, item)
+		}
+	}
+	return d.loadSnapshotKV(r)
+}
+
+func readItem(r io.Reader) (opaqueCacheItem, error) {
+	var createdNanos int64
+	if err := binary.Read(r, binary.BigEndian, &createdNanos); err != nil {
+		return nil, err
+	}
+	var validitySec int64
+	if err := binary.Read(r, binary.BigEndian, &validitySec); err != nil {
+		return nil, err
+	}
+	var isDNSSEC bool
+	if err := binary.Read(r, binary.BigEndian, &isDNSSEC); err != nil {
+		return nil, err
+	}
+	payload, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Unix(0, createdNanos)
+	validity := time.Duration(validitySec) * time.Second
+	if created.Add(validity).Before(time.Now()) {
+		return nil, nil /// remaining validity has already run out
+	}
+
+	if isDNSSEC {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(payload); err != nil {
+			return nil, err
+		}
+		return &responseCache{created, validity, msg, 0}, nil
+	}
+	rr, err := dns.NewRR(string(payload))
+	if err != nil {
+		return nil, err
+	}
+	extra, err := readItemCacheExtra(r)
+	if err != nil {
+		return nil, err
+	}
+	return &itemCache{created, validity, rr, extra, 0}, nil
+}
+
+func readItemCacheExtra(r io.Reader) (*ItemCacheExtra, error) {
+	var present bool
+	if err := binary.Read(r, binary.BigEndian, &present); err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, nil
+	}
+	val := &ItemCacheExtra{}
+	if err := binary.Read(r, binary.BigEndian, &val.Nxdomain); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &val.Nodata); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &val.Cname); err != nil {
+		return nil, err
+	}
+	var numRedirect uint32
+	if err := binary.Read(r, binary.BigEndian, &numRedirect); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < numRedirect; i++ {
+		s, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			return nil, fmt.Errorf("cache: expected CNAME in persisted redirect, got %T", rr)
+		}
+		val.Redirect = append(val.Redirect, cname)
+	}
+	return val, nil
+}
+
+func (d *DNSCache) loadSnapshotKV(r io.Reader) error {
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return err
+		}
+		var kind byte
+		if err := binary.Read(r, binary.BigEndian, &kind); err != nil {
+			return err
+		}
+		switch kind {
+		case snapshotKVString:
+			s, err := readString(r)
+			if err != nil {
+				return err
+			}
+			d.k.Store(key, s)
+		case snapshotKVInt:
+			var v int64
+			if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+				return err
+			}
+			d.k.Store(key, int(v))
+		case snapshotKVBool:
+			var v bool
+			if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+				return err
+			}
+			d.k.Store(key, v)
+		default:
+			return fmt.Errorf("cache: unknown kv value kind %d in snapshot", kind)
+		}
+	}
+	return nil
+}
+
+func writeBytes(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func writeString(w io.Writer, s string) error {
+	return writeBytes(w, []byte(s))
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func readString(r io.Reader) (string, error) {
+	b, err := readBytes(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+/*
+** HTTP debug/introspection surface
+ */
+
+type debugProviderStat struct {
+	Name        string `json:"name"`
+	Entries     int    `json:"entries"`
+	ApproxBytes int64  `json:"approx_bytes"`
+}
+
+type debugDumpEntry struct {
+	Domain       string `json:"domain"`
+	Qtype        string `json:"qtype"`
+	DNSSEC       bool   `json:"dnssec"`
+	TTLRemaining int64  `json:"ttl_remaining"`
+	Record       string `json:"record,omitempty"`
+	Nxdomain     bool   `json:"nxdomain,omitempty"`
+	Nodata       bool   `json:"nodata,omitempty"`
+	Cname        bool   `json:"cname,omitempty"`
+	Stale        bool   `json:"stale,omitempty"`
+}
+
+// RegisterDebugHandlers wires a small introspection/ops surface for the
+// cache onto mux, rooted at prefix (e.g. "/debug/cache"). Borrows the
+// "RegisterDebugHandlers" pattern from dnss's CachingResolver.
+func (d *DNSCacheHolder) RegisterDebugHandlers(mux *http.ServeMux, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	mux.HandleFunc(prefix+"/providers", d.handleDebugProviders)
+	mux.HandleFunc(prefix+"/dump", d.handleDebugDump)
+	mux.HandleFunc(prefix+"/flush", d.handleDebugFlush)
+	mux.HandleFunc(prefix+"/kv", d.handleDebugKV)
+}
+
+func (d *DNSCacheHolder) handleDebugProviders(w http.ResponseWriter, r *http.Request) {
+	stats := make([]debugProviderStat, 0, len(d.m))
+	for name, c := range d.m {
+		entries, size := c.debugStats()
+		stats = append(stats, debugProviderStat{Name: name, Entries: entries, ApproxBytes: size})
+	}
+	writeDebugJSON(w, stats)
+}
+
+func (d *DNSCacheHolder) handleDebugDump(w http.ResponseWriter, r *http.Request) {
+	provider := r.URL.Query().Get("provider")
+	domain := r.URL.Query().Get("domain")
+	c, ok := d.m[provider]
+	if !ok || domain == "" {
+		http.Error(w, "provider and domain query params are required", http.StatusBadRequest)
+		return
+	}
+	writeDebugJSON(w, c.debugDump(domain))
+}
+
+func (d *DNSCacheHolder) handleDebugFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	provider := r.URL.Query().Get("provider")
+	c, ok := d.m[provider]
+	if !ok {
+		http.Error(w, "unknown provider", http.StatusBadRequest)
+		return
+	}
+
+	var qtype uint16
+	if qtypeParam := r.URL.Query().Get("qtype"); qtypeParam != "" {
+		t, ok := dns.StringToType[strings.ToUpper(qtypeParam)]
+		if !ok {
+			http.Error(w, "unknown qtype", http.StatusBadRequest)
+			return
+		}
+		qtype = t
+	}
+
+	flushed := c.debugFlush(r.URL.Query().Get("domain"), qtype)
+	writeDebugJSON(w, map[string]int{"flushed": flushed})
+}
+
+func (d *DNSCacheHolder) handleDebugKV(w http.ResponseWriter, r *http.Request) {
+	provider := r.URL.Query().Get("provider")
+	c, ok := d.m[provider]
+	if !ok {
+		http.Error(w, "unknown provider", http.StatusBadRequest)
+		return
+	}
+	out := make(map[string]interface{})
+	c.k.Range(func(rawKey, rawVal interface{}) bool {
+		if key, ok := rawKey.(string); ok {
+			out[key] = rawVal
+		}
+		return true
+	})
+	writeDebugJSON(w, out)
+}
+
+func (d *DNSCache) debugStats() (entries int, approxBytes int64) {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	for _, dom := range d.l {
+		dom.m.RLock()
+		for _, items := range dom.l {
+			for _, it := range items {
+				entries++
+				approxBytes += debugItemSize(it)
+			}
+		}
+		dom.m.RUnlock()
+	}
+	return
+}
+
+func debugItemSize(it opaqueCacheItem) int64 {
+	switch v := it.(type) {
+	case *responseCache:
+		packed, err := v.Msg.Pack()
+		if err != nil {
+			return 0
+		}
+		return int64(len(packed))
+	case *itemCache:
+		return int64(len(v.RR.String()))
+	}
+	return 0
+}
+
+func (d *DNSCache) debugDump(domain string) []debugDumpEntry {
+	domain = strings.ToLower(domain)
+	d.m.RLock()
+	dom, ok := d.l[domain]
+	if !ok {
+		d.m.RUnlock()
+		return nil
+	}
+	dom.m.RLock()
+	d.m.RUnlock()
+	defer dom.m.RUnlock()
+
+	out := []debugDumpEntry{}
+	for rrtype, items := range dom.l {
+		for _, it := range items {
+			remaining := it.validity() - time.Now().Sub(it.timeCreated())
+			e := debugDumpEntry{
+				Domain:       domain,
+				Qtype:        dns.TypeToString[rrtype],
+				DNSSEC:       it.isDNSSECStore(),
+				TTLRemaining: int64(remaining / time.Second),
+			}
+			switch v := it.(type) {
+			case *itemCache:
+				e.Record = v.RR.String()
+				if v.val != nil {
+					e.Nxdomain, e.Nodata, e.Cname, e.Stale = v.val.Nxdomain, v.val.Nodata, v.val.Cname, v.val.Stale
+				}
+			case *responseCache:
+				e.Record = v.Msg.String()
+			}
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// debugFlush removes matching entries from the cache -- it backs the debug
+// /flush HTTP handler as well as Invalidate/InvalidateAll/InsertWithFlags. An
+// empty domain flushes everything; an empty qtype (0) flushes every rrtype
+// for the given domain. It returns the number of entries removed. The
+// matching LRU nodes are pruned as well (a full flush rebuilds the list
+// empty), so the capacity count only covers live entries.
+func (d *DNSCache) debugFlush(domain string, qtype uint16) (flushed int) {
+	if domain == "" {
+		d.m.Lock()
+		for _, dom := range d.l {
+			dom.m.RLock()
+			for _, items := range dom.l {
+				flushed += len(items)
+			}
+			dom.m.RUnlock()
+		}
+		d.l = make(map[string]*domainCache)
+		if d.cap > 0 {
+			/// every node's backing entry is gone -- rebuild the list empty
+			/// rather than let it hold a capacity's worth of orphans
+			d.lru = newLRUList(d.cap)
+		}
+		d.m.Unlock()
+		return
+	}
+
+	domain = strings.ToLower(domain)
+	d.m.Lock()
+	dom, ok := d.l[domain]
+	if !ok {
+		d.m.Unlock()
+		return
+	}
+	dom.m.Lock()
+	if qtype == 0 {
+		for t, items := range dom.l {
+			flushed += len(items)
+			if d.cap > 0 {
+				for k := range items {
+					d.lru.remove(domain, t, k)
+				}
+			}
+		}
+		delete(d.l, domain)
+	} else {
+		flushed = len(dom.l[qtype])
+		if d.cap > 0 {
+			for k := range dom.l[qtype] {
+				d.lru.remove(domain, qtype, k)
+			}
+		}
+		delete(dom.l, qtype)
+	}
+	dom.m.Unlock()
+	d.m.Unlock()
+	return
+}
+
+func writeDebugJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 /*
 ** Helpers and convenience methods
  */
@@ -0,0 +1,187 @@
+/**
+ * Tenta DNS Server
+ *
+ *    Copyright 2017 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * cache_test.go: Tests for the DNS cache
+ */
+
+package runtime
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Entry {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return l.WithField("test", true)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("dns.NewRR(%q): %v", s, err)
+	}
+	return rr
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	holder := StartCache(testLogger(), "test")
+	defer holder.Stop()
+
+	holder.Insert("test", "example.com.", mustRR(t, "example.com. 3600 IN A 1.2.3.4"), nil)
+	holder.Insert("test", "bad.example.com.", mustRR(t, "bad.example.com. 3600 IN A 0.0.0.0"),
+		&ItemCacheExtra{
+			Nxdomain: true,
+			Redirect: []*dns.CNAME{mustRR(t, "bad.example.com. 3600 IN CNAME target.example.com.").(*dns.CNAME)},
+		})
+	holder.Put("test", "a-string", "value")
+	holder.Put("test", "an-int", 7)
+	holder.Put("test", "a-bool", true)
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := holder.Snapshot(path); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	restored := StartCache(testLogger(), "test")
+	defer restored.Stop()
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+
+	plain, _ := restored.Retrieve("test", "example.com.", dns.TypeA, false)
+	if got := AsRR(plain); len(got) != 1 || got[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Fatalf("Retrieve(example.com.) = %v, want the original A record", got)
+	}
+
+	_, extra := restored.Retrieve("test", "bad.example.com.", dns.TypeA, false)
+	if extra == nil || !extra.Nxdomain {
+		t.Fatalf("Retrieve(bad.example.com.) extra = %+v, want Nxdomain restored", extra)
+	}
+	if len(extra.Redirect) != 1 || extra.Redirect[0].Target != "target.example.com." {
+		t.Fatalf("Retrieve(bad.example.com.) extra.Redirect = %v, want the original CNAME chain", extra.Redirect)
+	}
+
+	if s, ok := restored.GetString("test", "a-string"); !ok || s != "value" {
+		t.Fatalf("GetString(a-string) = (%q, %v), want (\"value\", true)", s, ok)
+	}
+	if i, ok := restored.GetInt("test", "an-int"); !ok || i != 7 {
+		t.Fatalf("GetInt(an-int) = (%d, %v), want (7, true)", i, ok)
+	}
+	if b, ok := restored.GetBool("test", "a-bool"); !ok || !b {
+		t.Fatalf("GetBool(a-bool) = (%v, %v), want (true, true)", b, ok)
+	}
+}
+
+func TestCleanupBucketIndexRoundsUp(t *testing.T) {
+	cases := []struct {
+		o, when int64
+	}{
+		{o: 0, when: 1},                       // not a multiple of the interval
+		{o: 0, when: CACHE_EVICTION_RATE},     // exactly on a bucket boundary
+		{o: 0, when: CACHE_EVICTION_RATE + 1}, // just past a boundary
+		{o: 1000, when: 1000 + 2*CACHE_EVICTION_RATE - 1},
+	}
+	for _, c := range cases {
+		index := cleanupBucketIndex(c.o, c.when)
+		if index < c.when {
+			t.Fatalf("cleanupBucketIndex(%d, %d) = %d, fires before the entry expires", c.o, c.when, index)
+		}
+		if (index-c.o)%CACHE_EVICTION_RATE != 0 {
+			t.Fatalf("cleanupBucketIndex(%d, %d) = %d, not aligned to the eviction interval", c.o, c.when, index)
+		}
+	}
+}
+
+func TestLRUPrunedOnExpiry(t *testing.T) {
+	holder := StartCache(testLogger(), "test")
+	defer holder.Stop()
+	holder.SetCapacity("test", 10)
+
+	holder.Insert("test", "example.com.", mustRR(t, "example.com. 1 IN A 1.2.3.4"), nil)
+
+	c := holder.m["test"]
+	if c.lru.size != 1 {
+		t.Fatalf("lru.size = %d right after insert, want 1", c.lru.size)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, extra := holder.Retrieve("test", "example.com.", dns.TypeA, false); extra != nil {
+		t.Fatalf("Retrieve on an expired, non-stale entry returned extra %+v, want nil", extra)
+	}
+
+	if c.lru.size != 0 {
+		t.Fatalf("lru.size = %d after the entry expired, want 0 (orphaned node)", c.lru.size)
+	}
+}
+
+func TestLRUPrunedOnDebugFlush(t *testing.T) {
+	holder := StartCache(testLogger(), "test")
+	defer holder.Stop()
+	holder.SetCapacity("test", 10)
+
+	holder.Insert("test", "example.com.", mustRR(t, "example.com. 3600 IN A 1.2.3.4"), nil)
+	holder.Insert("test", "other.com.", mustRR(t, "other.com. 3600 IN A 5.6.7.8"), nil)
+
+	c := holder.m["test"]
+	if c.lru.size != 2 {
+		t.Fatalf("lru.size = %d after two inserts, want 2", c.lru.size)
+	}
+
+	holder.Invalidate("test", "example.com.", dns.TypeA)
+	if c.lru.size != 1 {
+		t.Fatalf("lru.size = %d after invalidating one entry, want 1", c.lru.size)
+	}
+
+	holder.InvalidateAll("test")
+	if c.lru.size != 0 {
+		t.Fatalf("lru.size = %d after InvalidateAll, want 0", c.lru.size)
+	}
+}
+
+func TestSnapshotSkipsExpiredEntries(t *testing.T) {
+	holder := StartCache(testLogger(), "test")
+	defer holder.Stop()
+	holder.Insert("test", "example.com.", mustRR(t, "example.com. 1 IN A 1.2.3.4"), nil)
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := holder.Snapshot(path); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	restored := StartCache(testLogger(), "test")
+	defer restored.Stop()
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+
+	plain, _ := restored.Retrieve("test", "example.com.", dns.TypeA, false)
+	if got := AsRR(plain); len(got) != 0 {
+		t.Fatalf("Retrieve after loading an expired snapshot = %v, want none", got)
+	}
+}